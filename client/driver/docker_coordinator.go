@@ -1,17 +1,39 @@
 package driver
 
 import (
+	"archive/tar"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
-	docker "github.com/fsouza/go-dockerclient"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+const (
+	// defaultPullActivityTimeout is how long we wait without seeing any pull
+	// progress before we give up on a pull and cancel it.
+	defaultPullActivityTimeout = 2 * time.Minute
+
+	// defaultPullProgressReportInterval is how often we log an aggregate
+	// summary of an in-flight pull's progress.
+	defaultPullProgressReportInterval = 60 * time.Second
+)
+
 var (
 	// createCoordinator allows us to only create a single coordinator
 	createCoordinator sync.Once
@@ -20,11 +42,21 @@ var (
 	// using the GetDockerCoordinator() method.
 	globalCoordinator *dockerCoordinator
 
-	// imageNotFoundMatcher is a regex expression that matches the image not
-	// found error Docker returns.
-	imageNotFoundMatcher = regexp.MustCompile(`Error: image .+ not found`)
+	// streamNotFoundMatcher matches the image-not-found style messages
+	// Docker embeds inline in the pull JSON stream. Unlike the non-streaming
+	// client, the streaming ImagePull API never returns a distinct 404; it
+	// reports these as just another line in the stream, so we have to
+	// recognize them by message text.
+	streamNotFoundMatcher = regexp.MustCompile(`(?i)(not found|manifest unknown|pull access denied|repository does not exist)`)
 )
 
+// notFoundError tags an error parsed out of the pull stream as a "not
+// found" so it satisfies errdefs.IsNotFound the same way a registry 404
+// would from the HTTP client.
+type notFoundError struct{ error }
+
+func (notFoundError) NotFound() {}
+
 // pullFuture is a sharable future for retrieving a pulled images ID and any
 // error that may have occured during the pull.
 type pullFuture struct {
@@ -64,9 +96,98 @@ func (p *pullFuture) set(imageID string, err error) {
 // DockerImageClient provides the methods required to do CRUD operations on the
 // Docker images
 type DockerImageClient interface {
-	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
-	InspectImage(id string) (*docker.Image, error)
-	RemoveImage(id string) error
+	ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error)
+}
+
+// archiveSourcePrefixes are the jobspec image string prefixes that indicate
+// the image should be loaded from a local tar/OCI layout on disk instead of
+// pulled from a registry.
+var archiveSourcePrefixes = []string{"oci-archive:", "docker-archive:", "oci-layout:"}
+
+// archiveSource returns the prefix that matched and the filesystem path
+// encoded in image, and true if image names a local OCI layout or tarball
+// rather than a registry reference. For docker-archive/oci-archive sources,
+// skopeo-style callers may append an optional ":<reference>" to the path
+// (e.g. "docker-archive:/img.tar:v1"); that suffix is stripped so the
+// remainder is a bare filesystem path.
+func archiveSource(image string) (prefix, path string, ok bool) {
+	for _, p := range archiveSourcePrefixes {
+		if !strings.HasPrefix(image, p) {
+			continue
+		}
+		rest := strings.TrimPrefix(image, p)
+		if p != "oci-layout:" {
+			if idx := strings.Index(rest, ":"); idx != -1 {
+				rest = rest[:idx]
+			}
+		}
+		return p, rest, true
+	}
+	return "", "", false
+}
+
+// tarDirectory streams dir as a tar archive rooted at dir itself, the format
+// ImageLoad expects for an OCI layout (which is a directory, not a tarball,
+// on disk). The archive is built incrementally into an io.Pipe so the whole
+// layout never needs to be buffered in memory.
+func tarDirectory(dir string) (io.ReadCloser, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("statting oci-layout %q: %w", dir, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// newDockerAPIClient returns a new Docker API client, negotiating the API
+// version with the daemon rather than pinning it so Nomad keeps working
+// across daemon upgrades.
+func newDockerAPIClient() (*client.Client, error) {
+	return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 }
 
 // dockerCoordinatorConfig is used to configure the Docker coordinator.
@@ -84,6 +205,20 @@ type dockerCoordinatorConfig struct {
 	// removeDelay is the delay between an image's reference count going to
 	// zero and the image actually being deleted.
 	removeDelay time.Duration
+
+	// pullActivityTimeout is the duration of inactivity (no progress message
+	// received from Docker) after which an in-flight pull is cancelled.
+	pullActivityTimeout time.Duration
+
+	// pullProgressReportInterval is how often an aggregate summary of an
+	// in-flight pull's progress is emitted to the logger.
+	pullProgressReportInterval time.Duration
+
+	// credProvider, if set, is consulted for per-image registry auth before
+	// falling back to the AuthConfig passed to PullImage. It lets the
+	// coordinator resolve credentials dynamically (docker config.json,
+	// ECR, GCR) instead of relying solely on a jobspec-provided static auth.
+	credProvider CredentialProvider
 }
 
 // dockerCoordinator is used to coordinate actions against images to prevent
@@ -98,8 +233,10 @@ type dockerCoordinator struct {
 	// only have one request be sent to Docker
 	pullFutures map[string]*pullFuture
 
-	// imageRefCount is the reference count of image IDs
-	imageRefCount map[string]int
+	// imageRefCount maps an image ID to the set of caller IDs (e.g.
+	// alloc+task UUIDs) currently holding a reference to it. An image is
+	// only eligible for removal once its set is empty.
+	imageRefCount map[string]map[string]struct{}
 
 	// deleteFuture is indexed by image ID and has a cancable delete future
 	deleteFuture map[string]context.CancelFunc
@@ -110,11 +247,20 @@ func NewDockerCoordinator(config *dockerCoordinatorConfig) *dockerCoordinator {
 	if config.client == nil {
 		return nil
 	}
+	if config.pullActivityTimeout == 0 {
+		config.pullActivityTimeout = defaultPullActivityTimeout
+	}
+	if config.pullProgressReportInterval == 0 {
+		config.pullProgressReportInterval = defaultPullProgressReportInterval
+	}
+	if config.credProvider == nil {
+		config.credProvider = newDefaultCredentialProviders(config.logger)
+	}
 
 	return &dockerCoordinator{
 		dockerCoordinatorConfig: config,
 		pullFutures:             make(map[string]*pullFuture),
-		imageRefCount:           make(map[string]int),
+		imageRefCount:           make(map[string]map[string]struct{}),
 		deleteFuture:            make(map[string]context.CancelFunc),
 	}
 }
@@ -128,9 +274,16 @@ func GetDockerCoordinator(config *dockerCoordinatorConfig) *dockerCoordinator {
 	return globalCoordinator
 }
 
+// emitFn is used by callers of PullImage to receive human readable progress
+// events as the pull proceeds. It mirrors the signature of the task event
+// emitter so it can be wired straight through to a task's event stream.
+type emitFn func(string, ...interface{})
+
 // PullImage is used to pull an image. It returns the pulled imaged ID or an
-// error that occured during the pull
-func (d *dockerCoordinator) PullImage(image string, authOptions *docker.AuthConfiguration) (imageID string, err error) {
+// error that occured during the pull. The supplied callerID (typically an
+// alloc+task identifier) is recorded as holding a reference to the image so
+// RemoveImage can later release exactly that reference.
+func (d *dockerCoordinator) PullImage(image string, authOptions *registry.AuthConfig, callerID string, emit emitFn) (imageID string, err error) {
 	// Lock while we look up the future
 	d.imageLock.Lock()
 
@@ -140,7 +293,11 @@ func (d *dockerCoordinator) PullImage(image string, authOptions *docker.AuthConf
 		// Make the future
 		future = newPullFuture()
 		d.pullFutures[image] = future
-		go d.pullImageImpl(image, authOptions, future)
+		if prefix, path, ok := archiveSource(image); ok {
+			go d.loadImageImpl(image, prefix, path, emit, future)
+		} else {
+			go d.pullImageImpl(image, authOptions, emit, future)
+		}
 	}
 	d.imageLock.Unlock()
 
@@ -149,55 +306,357 @@ func (d *dockerCoordinator) PullImage(image string, authOptions *docker.AuthConf
 
 	// If we are cleaning up, we increment the reference count on the image
 	if err == nil && d.cleanup {
-		d.IncrementImageReference(id, image)
+		d.IncrementImageReference(id, image, callerID)
 	}
 
 	return id, err
 }
 
+// layerProgress tracks the most recently reported status for a single image
+// layer as it is pulled.
+type layerProgress struct {
+	status     string
+	current    int64
+	total      int64
+	lastUpdate time.Time
+}
+
 // pullImageImpl is the implementation of pulling an image. The results are
 // returned via the passed future
-func (d *dockerCoordinator) pullImageImpl(image string, authOptions *docker.AuthConfiguration, future *pullFuture) {
-	// Parse the repo and tag
-	repo, tag := docker.ParseRepositoryTag(image)
-	if tag == "" {
-		tag = "latest"
+func (d *dockerCoordinator) pullImageImpl(img string, authOptions *registry.AuthConfig, emit emitFn, future *pullFuture) {
+	// Parse and normalize the reference, defaulting to the "latest" tag the
+	// same way the Docker daemon does.
+	ref, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed parsing image reference %q: %v", img, err)
+		future.set("", recoverablePullError(err, img))
+		return
+	}
+	ref = reference.TagNameOnly(ref)
+	refStr := ref.String()
+
+	auth, err := d.resolveAuth(reference.Domain(ref), authOptions)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed resolving registry credentials for %q: %v", img, err)
+		future.set("", recoverablePullError(err, img))
+		return
+	}
+	encodedAuth, err := encodeRegistryAuth(auth)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed encoding registry auth for %q: %v", img, err)
+		future.set("", recoverablePullError(err, img))
+		return
 	}
-	pullOptions := docker.PullImageOptions{
-		Repository: repo,
-		Tag:        tag,
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rc, err := d.client.ImagePull(ctx, refStr, image.PullOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed pulling container %s: %s", refStr, err)
+		future.set("", recoverablePullError(err, img))
+		return
 	}
+	defer rc.Close()
+
+	activity := make(chan struct{}, 1)
+
+	// Watch for inactivity and cancel the pull if Docker stops reporting
+	// progress for longer than the configured timeout.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		timer := time.NewTimer(d.pullActivityTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-activity:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(d.pullActivityTimeout)
+			case <-timer.C:
+				d.logger.Printf("[ERR] driver.docker: no pull progress for %s in %v; cancelling",
+					refStr, d.pullActivityTimeout)
+				cancel()
+				return
+			}
+		}
+	}()
 
-	// Attempt to pull the image
-	var auth docker.AuthConfiguration
-	if authOptions != nil {
-		auth = *authOptions
+	if err := d.trackPullProgress(img, rc, activity, emit); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("pull cancelled due to inactivity: %v", err)
+		}
+		d.logger.Printf("[ERR] driver.docker: failed pulling container %s: %s", refStr, err)
+		future.set("", recoverablePullError(err, img))
+		return
 	}
-	err := d.client.PullImage(pullOptions, auth)
+
+	d.logger.Printf("[DEBUG] driver.docker: docker pull %s succeeded", refStr)
+
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), img)
 	if err != nil {
-		d.logger.Printf("[ERR] driver.docker: failed pulling container %s:%s: %s", repo, tag, err)
-		future.set("", recoverablePullError(err, image))
+		d.logger.Printf("[ERR] driver.docker: failed getting image id for %q: %v", img, err)
+		future.set("", recoverableErrTimeouts(err))
 		return
 	}
 
-	d.logger.Printf("[DEBUG] driver.docker: docker pull %s:%s succeeded", repo, tag)
+	future.set(inspect.ID, nil)
+	return
+}
+
+// loadImageImplIDMatcher extracts the resulting image ID or name:tag from the
+// "stream" lines Docker emits in response to an image load.
+var loadImageImplIDMatcher = regexp.MustCompile(`Loaded image(?: ID)?: (\S+)`)
+
+// loadImageImpl is the sibling of pullImageImpl for images sourced from a
+// local tar/OCI layout rather than a registry. Reference counting and
+// delayed deletion behave identically to a registry pull once the future is
+// populated.
+func (d *dockerCoordinator) loadImageImpl(img, prefix, path string, emit emitFn, future *pullFuture) {
+	var stream io.ReadCloser
+	if prefix == "oci-layout:" {
+		// The daemon's image load API only accepts a docker-save-style tar
+		// stream; an OCI layout is a directory, so it's streamed as an
+		// on-the-fly tar instead of being opened as a file.
+		s, err := tarDirectory(path)
+		if err != nil {
+			d.logger.Printf("[ERR] driver.docker: failed archiving oci-layout %q: %v", path, err)
+			future.set("", recoverablePullError(err, img))
+			return
+		}
+		stream = s
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			d.logger.Printf("[ERR] driver.docker: failed opening image archive %q: %v", path, err)
+			future.set("", recoverablePullError(err, img))
+			return
+		}
+		stream = f
+	}
+	defer stream.Close()
 
-	dockerImage, err := d.client.InspectImage(image)
+	resp, err := d.client.ImageLoad(context.Background(), stream, true)
 	if err != nil {
-		d.logger.Printf("[ERR] driver.docker: failed getting image id for %q: %v", image, err)
+		d.logger.Printf("[ERR] driver.docker: failed loading image archive %q: %v", path, err)
+		future.set("", recoverablePullError(err, img))
+		return
+	}
+	defer resp.Body.Close()
+
+	loadedID, err := parseLoadResponse(resp.Body)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed parsing load response for %q: %v", path, err)
+		future.set("", recoverablePullError(err, img))
+		return
+	}
+
+	line := fmt.Sprintf("loaded image %s from %s", img, path)
+	d.logger.Printf("[DEBUG] driver.docker: %s", line)
+	if emit != nil {
+		emit(line)
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), loadedID)
+	if err != nil {
+		d.logger.Printf("[ERR] driver.docker: failed getting image id for %q: %v", loadedID, err)
 		future.set("", recoverableErrTimeouts(err))
 		return
 	}
 
-	future.set(dockerImage.ID, nil)
+	future.set(inspect.ID, nil)
 	return
 }
 
-// IncrementImageReference is used to increment an image reference count
-func (d *dockerCoordinator) IncrementImageReference(id, image string) {
+// parseLoadResponse reads the JSON stream returned by ImageLoad and extracts
+// the ID (or name:tag) of the image that was loaded.
+func parseLoadResponse(r io.Reader) (string, error) {
+	var loadedID string
+	dec := json.NewDecoder(r)
+	for {
+		var m struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		if m.Error != "" {
+			return "", fmt.Errorf("%s", m.Error)
+		}
+		if match := loadImageImplIDMatcher.FindStringSubmatch(m.Stream); match != nil {
+			loadedID = match[1]
+		}
+	}
+
+	if loadedID == "" {
+		return "", fmt.Errorf("unable to determine image ID from load response")
+	}
+	return loadedID, nil
+}
+
+// trackPullProgress consumes the jsonmessage stream Docker emits while
+// pulling an image, maintaining per-layer progress and periodically emitting
+// a human readable aggregate summary. It signals the activity channel every
+// time a progress message is received so the caller can detect a stalled
+// pull, and returns an error if the stream itself reports one.
+func (d *dockerCoordinator) trackPullProgress(image string, r io.Reader, activity chan<- struct{}, emit emitFn) error {
+	layers := make(map[string]*layerProgress)
+	ticker := time.NewTicker(d.pullProgressReportInterval)
+	defer ticker.Stop()
+
+	type jsonMessage struct {
+		ID             string `json:"id"`
+		Status         string `json:"status"`
+		Error          string `json:"error"`
+		ProgressDetail struct {
+			Current int64 `json:"current"`
+			Total   int64 `json:"total"`
+		} `json:"progressDetail"`
+	}
+
+	type decodeResult struct {
+		msg jsonMessage
+		err error
+	}
+	updates := make(chan decodeResult)
+
+	// done lets us unblock the decode goroutine if we return early (e.g. on
+	// a stream error) while it's still waiting to send; without it, a
+	// goroutine that decoded one message and is blocked sending the next
+	// would leak forever since nothing would be left reading from updates.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(updates)
+		dec := json.NewDecoder(r)
+		for {
+			var m jsonMessage
+			if err := dec.Decode(&m); err != nil {
+				if err != io.EOF {
+					select {
+					case updates <- decodeResult{err: err}:
+					case <-done:
+					}
+				}
+				return
+			}
+			select {
+			case updates <- decodeResult{msg: m}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				d.logPullSummary(image, layers, emit)
+				return nil
+			}
+			if u.err != nil {
+				return u.err
+			}
+			if u.msg.Error != "" {
+				streamErr := fmt.Errorf("%s", u.msg.Error)
+				if streamNotFoundMatcher.MatchString(u.msg.Error) {
+					streamErr = notFoundError{streamErr}
+				}
+				return streamErr
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+			if u.msg.ID == "" {
+				continue
+			}
+			layers[u.msg.ID] = &layerProgress{
+				status:     u.msg.Status,
+				current:    u.msg.ProgressDetail.Current,
+				total:      u.msg.ProgressDetail.Total,
+				lastUpdate: time.Now(),
+			}
+		case <-ticker.C:
+			d.logPullSummary(image, layers, emit)
+		}
+	}
+}
+
+// logPullSummary emits a single aggregate line summarizing how many layers
+// of an image have finished downloading.
+func (d *dockerCoordinator) logPullSummary(image string, layers map[string]*layerProgress, emit emitFn) {
+	if len(layers) == 0 {
+		return
+	}
+
+	var done int
+	for _, l := range layers {
+		if l.status == "Pull complete" || l.status == "Already exists" {
+			done++
+		}
+	}
+	pct := 100 * done / len(layers)
+	line := fmt.Sprintf("pulling image %s: %d/%d layers downloaded (%d%%)", image, done, len(layers), pct)
+	d.logger.Printf("[DEBUG] driver.docker: %s", line)
+	if emit != nil {
+		emit(line)
+	}
+}
+
+// resolveAuth determines the auth config to use for a pull from the given
+// registry host, preferring the coordinator's CredentialProvider (if any)
+// and falling back to the static auth passed to PullImage.
+func (d *dockerCoordinator) resolveAuth(host string, static *registry.AuthConfig) (registry.AuthConfig, error) {
+	if d.credProvider != nil {
+		resolved, err := d.credProvider.ResolveAuth(host)
+		if err != nil {
+			return registry.AuthConfig{}, err
+		}
+		if resolved != nil {
+			return *resolved, nil
+		}
+	}
+
+	if static != nil {
+		return *static, nil
+	}
+	return registry.AuthConfig{}, nil
+}
+
+// encodeRegistryAuth base64-encodes the given auth config for use as the
+// X-Registry-Auth header the Docker API expects.
+func encodeRegistryAuth(auth registry.AuthConfig) (string, error) {
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// IncrementImageReference is used to record that callerID holds a reference
+// to the given image ID. It is idempotent: calling it multiple times with
+// the same callerID (e.g. because a task restarted and re-pulled the same
+// image) only ever counts as a single reference.
+func (d *dockerCoordinator) IncrementImageReference(id, image, callerID string) {
 	d.imageLock.Lock()
-	d.imageRefCount[id] += 1
-	d.logger.Printf("[DEBUG] driver.docker: image %q (%v) reference count incremented: %d", image, id, d.imageRefCount[id])
+	callerIDs, ok := d.imageRefCount[id]
+	if !ok {
+		callerIDs = make(map[string]struct{})
+		d.imageRefCount[id] = callerIDs
+	}
+	callerIDs[callerID] = struct{}{}
+	d.logger.Printf("[DEBUG] driver.docker: image %q (%v) reference count incremented: %d", image, id, len(callerIDs))
 
 	// Cancel any pending delete
 	if cancel, ok := d.deleteFuture[id]; ok {
@@ -207,25 +666,41 @@ func (d *dockerCoordinator) IncrementImageReference(id, image string) {
 	d.imageLock.Unlock()
 }
 
-// RemoveImage removes the given image. If there are any errors removing the
-// image, the remove is retried internally.
-func (d *dockerCoordinator) RemoveImage(id string) {
+// IsInUse returns true if the given image ID is currently referenced by any
+// caller.
+func (d *dockerCoordinator) IsInUse(id string) bool {
+	d.imageLock.Lock()
+	defer d.imageLock.Unlock()
+	callerIDs, ok := d.imageRefCount[id]
+	return ok && len(callerIDs) > 0
+}
+
+// RemoveImage removes callerID's reference to the given image. If the
+// callerID never held a reference (e.g. a restarted task calling RemoveImage
+// a second time for the same alloc) this is a no-op. If there are any errors
+// removing the image once the last reference is released, the remove is
+// retried internally.
+func (d *dockerCoordinator) RemoveImage(id, callerID string) {
 	d.imageLock.Lock()
 	defer d.imageLock.Unlock()
 
-	references, ok := d.imageRefCount[id]
+	callerIDs, ok := d.imageRefCount[id]
 	if !ok {
 		d.logger.Printf("[WARN] driver.docker: RemoveImage on non-referenced counted image id %q", id)
 		return
 	}
 
-	// Decrement the reference count
-	references--
-	d.imageRefCount[id] = references
-	d.logger.Printf("[DEBUG] driver.docker: image id %q reference count decremented: %d", id, references)
+	if _, ok := callerIDs[callerID]; !ok {
+		// This caller doesn't hold (or already released) a reference;
+		// nothing to decrement.
+		return
+	}
+
+	delete(callerIDs, callerID)
+	d.logger.Printf("[DEBUG] driver.docker: image id %q reference count decremented: %d", id, len(callerIDs))
 
 	// Nothing to do
-	if references != 0 {
+	if len(callerIDs) != 0 {
 		return
 	}
 
@@ -256,16 +731,16 @@ func (d *dockerCoordinator) removeImageImpl(id string, ctx context.Context) {
 	}
 
 	for i := 0; i < 3; i++ {
-		err := d.client.RemoveImage(id)
+		_, err := d.client.ImageRemove(context.Background(), id, image.RemoveOptions{})
 		if err == nil {
 			break
 		}
 
-		if err == docker.ErrNoSuchImage {
+		if errdefs.IsNotFound(err) {
 			d.logger.Printf("[DEBUG] driver.docker: unable to cleanup image %q: does not exist", id)
 			return
 		}
-		if derr, ok := err.(*docker.Error); ok && derr.Status == 409 {
+		if errdefs.IsConflict(err) {
 			d.logger.Printf("[DEBUG] driver.docker: unable to cleanup image %q: still in use", id)
 			return
 		}
@@ -288,9 +763,6 @@ func (d *dockerCoordinator) removeImageImpl(id string, ctx context.Context) {
 // recoverablePullError wraps the error gotten when trying to pull and image if
 // the error is recoverable.
 func recoverablePullError(err error, image string) error {
-	recoverable := true
-	if imageNotFoundMatcher.MatchString(err.Error()) {
-		recoverable = false
-	}
+	recoverable := !errdefs.IsNotFound(err)
 	return structs.NewRecoverableError(fmt.Errorf("Failed to pull `%s`: %s", image, err), recoverable)
 }
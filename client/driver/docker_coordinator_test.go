@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+)
+
+// fakeDockerImageClient is a no-op DockerImageClient used to construct a
+// coordinator for tests that only exercise reference counting and never
+// actually talk to Docker.
+type fakeDockerImageClient struct{}
+
+func (fakeDockerImageClient) ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (fakeDockerImageClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	return types.ImageLoadResponse{Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (fakeDockerImageClient) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{ID: imageID}, nil, nil
+}
+
+func (fakeDockerImageClient) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	return nil, nil
+}
+
+func testCoordinator(t *testing.T) *dockerCoordinator {
+	t.Helper()
+	return NewDockerCoordinator(&dockerCoordinatorConfig{
+		logger:  log.New(os.Stderr, "", log.LstdFlags),
+		cleanup: true,
+		client:  fakeDockerImageClient{},
+	})
+}
+
+// TestDockerCoordinator_RestartStorm_SingleReference ensures that a task
+// which restarts and pulls the same image N times under the same callerID
+// is only ever counted as a single reference, and that releasing it once is
+// sufficient to free the image.
+func TestDockerCoordinator_RestartStorm_SingleReference(t *testing.T) {
+	coordinator := testCoordinator(t)
+	const imageID = "sha256:abc"
+	const callerID = "alloc-1/task-a"
+
+	for i := 0; i < 5; i++ {
+		coordinator.IncrementImageReference(imageID, "example.com/image:latest", callerID)
+	}
+
+	if !coordinator.IsInUse(imageID) {
+		t.Fatalf("expected image to be in use after repeated increments from the same caller")
+	}
+
+	coordinator.imageLock.Lock()
+	refs := len(coordinator.imageRefCount[imageID])
+	coordinator.imageLock.Unlock()
+	if refs != 1 {
+		t.Fatalf("expected a single reference for repeated increments from the same callerID, got %d", refs)
+	}
+
+	coordinator.RemoveImage(imageID, callerID)
+	if coordinator.IsInUse(imageID) {
+		t.Fatalf("expected image to no longer be in use after releasing its only reference")
+	}
+}
+
+// TestDockerCoordinator_RemoveImage_IdempotentAcrossRestarts ensures a
+// restarted task calling RemoveImage more than once for the same callerID
+// doesn't drive the reference count negative or double-release the image.
+func TestDockerCoordinator_RemoveImage_IdempotentAcrossRestarts(t *testing.T) {
+	coordinator := testCoordinator(t)
+	const imageID = "sha256:def"
+	const callerID = "alloc-2/task-b"
+
+	coordinator.IncrementImageReference(imageID, "example.com/image:latest", callerID)
+
+	coordinator.RemoveImage(imageID, callerID)
+	coordinator.RemoveImage(imageID, callerID)
+
+	if coordinator.IsInUse(imageID) {
+		t.Fatalf("expected image to be released after its only reference was removed")
+	}
+}
+
+// TestDockerCoordinator_MultipleCallers_SurviveIndependentRemoval ensures
+// that releasing one caller's reference does not affect an image still in
+// use by another caller.
+func TestDockerCoordinator_MultipleCallers_SurviveIndependentRemoval(t *testing.T) {
+	coordinator := testCoordinator(t)
+	const imageID = "sha256:ghi"
+
+	coordinator.IncrementImageReference(imageID, "example.com/image:latest", "alloc-1/task-a")
+	coordinator.IncrementImageReference(imageID, "example.com/image:latest", "alloc-2/task-b")
+
+	coordinator.RemoveImage(imageID, "alloc-1/task-a")
+	if !coordinator.IsInUse(imageID) {
+		t.Fatalf("expected image to remain in use while another caller still holds a reference")
+	}
+
+	coordinator.RemoveImage(imageID, "alloc-2/task-b")
+	if coordinator.IsInUse(imageID) {
+		t.Fatalf("expected image to no longer be in use once all callers released their reference")
+	}
+}
+
+// TestDockerCoordinator_IsInUse_UnknownImage ensures an image id that was
+// never referenced is reported as not in use rather than panicking or
+// returning a false positive.
+func TestDockerCoordinator_IsInUse_UnknownImage(t *testing.T) {
+	coordinator := testCoordinator(t)
+	if coordinator.IsInUse("sha256:unknown") {
+		t.Fatalf("expected an untracked image id to not be in use")
+	}
+}
@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+// CredentialProvider resolves registry authentication dynamically, keyed by
+// the registry hostname parsed from an image reference (e.g. "docker.io",
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com"). It lets PullImage look up
+// per-image auth instead of relying on a single static AuthConfig for every
+// pull.
+type CredentialProvider interface {
+	// ResolveAuth returns the auth config to use for host, or a nil result
+	// with a nil error if no credentials are configured for it and the pull
+	// should proceed anonymously.
+	ResolveAuth(host string) (*registry.AuthConfig, error)
+}
+
+// cachedRegistryAuth is a resolved auth config along with the time it
+// expires, shared by the credential providers that back onto short-lived
+// tokens (ECR, GCR).
+type cachedRegistryAuth struct {
+	auth   registry.AuthConfig
+	expiry time.Time
+}
+
+// credentialProviders chains together multiple CredentialProviders, querying
+// each in order and returning the first one that has a match for host.
+type credentialProviders []CredentialProvider
+
+func (cs credentialProviders) ResolveAuth(host string) (*registry.AuthConfig, error) {
+	for _, c := range cs {
+		auth, err := c.ResolveAuth(host)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			return auth, nil
+		}
+	}
+	return nil, nil
+}
+
+// newDefaultCredentialProviders assembles the default CredentialProvider
+// chain: the docker CLI's config.json (including credHelpers/credsStore),
+// followed by the built-in ECR and GCR providers. The docker config provider
+// is skipped, rather than failing construction, if it can't be set up (e.g.
+// no home directory), since the built-in providers are still useful without
+// it.
+func newDefaultCredentialProviders(logger *log.Logger) CredentialProvider {
+	var chain credentialProviders
+
+	dockerConfig, err := newDockerConfigCredentialProvider("")
+	if err != nil {
+		logger.Printf("[WARN] driver.docker: skipping docker config.json credential provider: %v", err)
+	} else {
+		chain = append(chain, dockerConfig)
+	}
+
+	chain = append(chain, newDefaultECRCredentialProvider(logger), newDefaultGCRCredentialProvider(logger))
+	return chain
+}
+
+// dockerConfigCredentialProvider resolves auth from the docker CLI's
+// ~/.docker/config.json, including credsStore/credHelpers entries that shell
+// out to docker-credential-* helpers on PATH.
+type dockerConfigCredentialProvider struct {
+	path string
+}
+
+// newDockerConfigCredentialProvider returns a provider backed by the given
+// docker config.json path. If path is empty, ~/.docker/config.json is used.
+func newDockerConfigCredentialProvider(path string) (*dockerConfigCredentialProvider, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".docker", "config.json")
+	}
+	return &dockerConfigCredentialProvider{path: path}, nil
+}
+
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuthEntry `json:"auths"`
+	CredsStore  string                           `json:"credsStore"`
+	CredHelpers map[string]string                `json:"credHelpers"`
+}
+
+type dockerConfigAuthEntry struct {
+	Auth string `json:"auth"`
+}
+
+func (p *dockerConfigCredentialProvider) load() (*dockerConfigFile, error) {
+	buf, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return &dockerConfigFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", p.path, err)
+	}
+	return &cfg, nil
+}
+
+func (p *dockerConfigCredentialProvider) ResolveAuth(host string) (*registry.AuthConfig, error) {
+	cfg, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if helper, ok := cfg.CredHelpers[host]; ok {
+		return runCredentialHelper(helper, host)
+	}
+
+	// Docker Hub is special-cased in config.json under its legacy v1 URL.
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		if helper, ok := cfg.CredHelpers["https://index.docker.io/v1/"]; ok {
+			return runCredentialHelper(helper, "https://index.docker.io/v1/")
+		}
+	}
+
+	if cfg.CredsStore != "" {
+		if auth, err := runCredentialHelper(cfg.CredsStore, host); err == nil && auth != nil {
+			return auth, nil
+		}
+	}
+
+	if entry, ok := cfg.Auths[host]; ok && entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("decoding auth entry for %q: %w", host, err)
+		}
+		user, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed auth entry for %q", host)
+		}
+		return &registry.AuthConfig{ServerAddress: host, Username: user, Password: pass}, nil
+	}
+
+	return nil, nil
+}
+
+// credHelperOutput mirrors the JSON docker-credential-* helpers write to
+// stdout in response to a "get" request.
+type credHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// runCredentialHelper shells out to the docker-credential-<helper> binary on
+// PATH the same way the docker CLI does, writing host to its stdin and
+// parsing the resulting JSON credentials from stdout.
+func runCredentialHelper(helper, host string) (*registry.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s get: %w", helper, err)
+	}
+
+	var out credHelperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("parsing docker-credential-%s output: %w", helper, err)
+	}
+
+	return &registry.AuthConfig{
+		ServerAddress: out.ServerURL,
+		Username:      out.Username,
+		Password:      out.Secret,
+	}, nil
+}
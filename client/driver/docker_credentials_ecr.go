@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// ecrTokenExpiryBuffer is how far ahead of a token's actual expiry we
+// proactively refresh it, so a pull never races a just-expired token.
+const ecrTokenExpiryBuffer = 30 * time.Minute
+
+// ecrRefreshRetryInterval is how soon a failed background refresh is
+// retried, so a single transient AWS error doesn't strand the cache with a
+// token that silently expires.
+const ecrRefreshRetryInterval = 30 * time.Second
+
+// ecrHostMatcher matches ECR registry hostnames, e.g.
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com", capturing the region.
+var ecrHostMatcher = regexp.MustCompile(`^\d+\.dkr\.ecr\.([\w-]+)\.amazonaws\.com$`)
+
+// ecrRegionFromHost extracts the AWS region encoded in an ECR registry
+// hostname.
+func ecrRegionFromHost(host string) (string, error) {
+	m := ecrHostMatcher.FindStringSubmatch(host)
+	if m == nil {
+		return "", fmt.Errorf("%q is not an ECR registry host", host)
+	}
+	return m[1], nil
+}
+
+// ecrAuthorizer is the subset of the AWS ECR API needed to exchange AWS
+// credentials for a registry auth token. Implementations typically wrap the
+// AWS SDK's ECR client.
+type ecrAuthorizer interface {
+	// GetAuthorizationToken returns a base64 "user:password" token and its
+	// expiry for the ECR registry backing host.
+	GetAuthorizationToken(host string) (token string, expiry time.Time, err error)
+}
+
+// awsECRAuthorizer implements ecrAuthorizer by exchanging the client's
+// ambient AWS credentials (environment, shared config, or instance/task
+// role) for a registry token via the AWS SDK, lazily creating one ECR
+// client per region as hosts in that region are seen.
+type awsECRAuthorizer struct {
+	mu      sync.Mutex
+	clients map[string]*ecr.ECR
+}
+
+// newAWSECRAuthorizer returns an ecrAuthorizer backed by the real AWS ECR
+// API.
+func newAWSECRAuthorizer() *awsECRAuthorizer {
+	return &awsECRAuthorizer{clients: make(map[string]*ecr.ECR)}
+}
+
+func (a *awsECRAuthorizer) clientForRegion(region string) (*ecr.ECR, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if client, ok := a.clients[region]; ok {
+		return client, nil
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS session for region %q: %w", region, err)
+	}
+
+	client := ecr.New(sess)
+	a.clients[region] = client
+	return client, nil
+}
+
+func (a *awsECRAuthorizer) GetAuthorizationToken(host string) (string, time.Time, error) {
+	region, err := ecrRegionFromHost(host)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	client, err := a.clientForRegion(region)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	resp, err := client.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("ecr:GetAuthorizationToken for region %q: %w", region, err)
+	}
+	if len(resp.AuthorizationData) == 0 {
+		return "", time.Time{}, fmt.Errorf("ecr:GetAuthorizationToken for region %q returned no authorization data", region)
+	}
+
+	data := resp.AuthorizationData[0]
+	return aws.StringValue(data.AuthorizationToken), aws.TimeValue(data.ExpiresAt), nil
+}
+
+// ecrCredentialProvider resolves auth for ECR registries by exchanging AWS
+// credentials for a short-lived registry token. Tokens are cached until
+// shortly before they expire and refreshed in the background so long-running
+// Nomad clients don't fail pulls when a token rotates mid-flight.
+type ecrCredentialProvider struct {
+	logger     *log.Logger
+	authorizer ecrAuthorizer
+
+	mu     sync.Mutex
+	cache  map[string]*cachedRegistryAuth
+	timers map[string]*time.Timer
+}
+
+func newECRCredentialProvider(logger *log.Logger, authorizer ecrAuthorizer) *ecrCredentialProvider {
+	return &ecrCredentialProvider{
+		logger:     logger,
+		authorizer: authorizer,
+		cache:      make(map[string]*cachedRegistryAuth),
+		timers:     make(map[string]*time.Timer),
+	}
+}
+
+// newDefaultECRCredentialProvider returns an ecrCredentialProvider backed by
+// the real AWS ECR API.
+func newDefaultECRCredentialProvider(logger *log.Logger) *ecrCredentialProvider {
+	return newECRCredentialProvider(logger, newAWSECRAuthorizer())
+}
+
+func (p *ecrCredentialProvider) ResolveAuth(host string) (*registry.AuthConfig, error) {
+	if !ecrHostMatcher.MatchString(host) {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	cached, ok := p.cache[host]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expiry.Add(-ecrTokenExpiryBuffer)) {
+		auth := cached.auth
+		return &auth, nil
+	}
+
+	return p.refresh(host)
+}
+
+func (p *ecrCredentialProvider) refresh(host string) (*registry.AuthConfig, error) {
+	token, expiry, err := p.authorizer.GetAuthorizationToken(host)
+	if err != nil {
+		return nil, fmt.Errorf("fetching ECR authorization token for %q: %w", host, err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("decoding ECR token for %q: %w", host, err)
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed ECR token for %q", host)
+	}
+
+	auth := registry.AuthConfig{ServerAddress: host, Username: user, Password: pass}
+
+	p.mu.Lock()
+	p.cache[host] = &cachedRegistryAuth{auth: auth, expiry: expiry}
+	p.mu.Unlock()
+
+	// Proactively refresh before the cached token expires so a subsequent
+	// pull doesn't have to wait on the AWS round trip.
+	if d := time.Until(expiry) - ecrTokenExpiryBuffer; d > 0 {
+		p.scheduleRefresh(host, d)
+	}
+
+	result := auth
+	return &result, nil
+}
+
+// scheduleRefresh refreshes host's token after the given delay. If the
+// refresh fails, the error is logged and another attempt is scheduled after
+// ecrRefreshRetryInterval so a transient failure can't strand the cache
+// with a token that silently expires. Any timer already pending for host is
+// replaced rather than left to run, so a burst of refreshes around the
+// expiry boundary can't accumulate multiple self-perpetuating chains for
+// the same host.
+func (p *ecrCredentialProvider) scheduleRefresh(host string, after time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.timers[host]; ok {
+		existing.Stop()
+	}
+	p.timers[host] = time.AfterFunc(after, func() {
+		if _, err := p.refresh(host); err != nil {
+			p.logger.Printf("[ERR] driver.docker: failed refreshing ECR credentials for %q: %v; retrying in %s", host, err, ecrRefreshRetryInterval)
+			p.scheduleRefresh(host, ecrRefreshRetryInterval)
+		}
+	})
+}
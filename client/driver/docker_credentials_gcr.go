@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+// gceMetadataTokenURL is the workload-identity metadata endpoint that serves
+// an OAuth2 access token for the instance's attached service account.
+const gceMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcrTokenExpiryBuffer is how far ahead of a token's actual expiry we
+// proactively refresh it.
+const gcrTokenExpiryBuffer = 5 * time.Minute
+
+// gcrRefreshRetryInterval is how soon a failed background refresh is
+// retried, so a single transient metadata-server error doesn't strand the
+// cache with a token that silently expires.
+const gcrRefreshRetryInterval = 30 * time.Second
+
+// gcrHostSuffixes are the registry hostnames served by Google Container
+// Registry and Artifact Registry.
+var gcrHostSuffixes = []string{"gcr.io", "pkg.dev"}
+
+func isGCRHost(host string) bool {
+	for _, suffix := range gcrHostSuffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gcrTokenSource is the subset of the GCE/workload-identity metadata client
+// needed to fetch an OAuth2 access token for pulling from GCR/Artifact
+// Registry.
+type gcrTokenSource interface {
+	// AccessToken returns an OAuth2 access token and its expiry from the
+	// instance or workload identity metadata server.
+	AccessToken() (token string, expiry time.Time, err error)
+}
+
+// gceMetadataTokenResponse mirrors the JSON body returned by the GCE
+// metadata server's service-account token endpoint.
+type gceMetadataTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// gceMetadataTokenSource implements gcrTokenSource by fetching an OAuth2
+// access token for the instance's attached service account from the
+// GCE/workload-identity metadata server.
+type gceMetadataTokenSource struct {
+	httpClient *http.Client
+}
+
+// newGCEMetadataTokenSource returns a gcrTokenSource backed by the real GCE
+// metadata server.
+func newGCEMetadataTokenSource() *gceMetadataTokenSource {
+	return &gceMetadataTokenSource{httpClient: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (s *gceMetadataTokenSource) AccessToken() (string, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, gceMetadataTokenURL, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("querying GCE metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("GCE metadata server returned status %d", resp.StatusCode)
+	}
+
+	var out gceMetadataTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing GCE metadata token response: %w", err)
+	}
+
+	return out.AccessToken, time.Now().Add(time.Duration(out.ExpiresIn) * time.Second), nil
+}
+
+// gcrCredentialProvider resolves auth for GCR/Artifact Registry hosts via
+// workload-identity metadata, caching the token until shortly before expiry
+// and refreshing it in the background.
+type gcrCredentialProvider struct {
+	logger      *log.Logger
+	tokenSource gcrTokenSource
+
+	mu           sync.Mutex
+	cached       *cachedRegistryAuth
+	refreshTimer *time.Timer
+}
+
+func newGCRCredentialProvider(logger *log.Logger, tokenSource gcrTokenSource) *gcrCredentialProvider {
+	return &gcrCredentialProvider{logger: logger, tokenSource: tokenSource}
+}
+
+// newDefaultGCRCredentialProvider returns a gcrCredentialProvider backed by
+// the real GCE metadata server.
+func newDefaultGCRCredentialProvider(logger *log.Logger) *gcrCredentialProvider {
+	return newGCRCredentialProvider(logger, newGCEMetadataTokenSource())
+}
+
+func (p *gcrCredentialProvider) ResolveAuth(host string) (*registry.AuthConfig, error) {
+	if !isGCRHost(host) {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	cached := p.cached
+	p.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expiry.Add(-gcrTokenExpiryBuffer)) {
+		auth := cached.auth
+		return &auth, nil
+	}
+
+	return p.refresh(host)
+}
+
+func (p *gcrCredentialProvider) refresh(host string) (*registry.AuthConfig, error) {
+	token, expiry, err := p.tokenSource.AccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("fetching workload identity token: %w", err)
+	}
+
+	// GCR/Artifact Registry accept an OAuth2 access token as the password
+	// with a fixed "oauth2accesstoken" username.
+	auth := registry.AuthConfig{ServerAddress: host, Username: "oauth2accesstoken", Password: token}
+
+	p.mu.Lock()
+	p.cached = &cachedRegistryAuth{auth: auth, expiry: expiry}
+	p.mu.Unlock()
+
+	if d := time.Until(expiry) - gcrTokenExpiryBuffer; d > 0 {
+		p.scheduleRefresh(host, d)
+	}
+
+	result := auth
+	return &result, nil
+}
+
+// scheduleRefresh refreshes host's token after the given delay. If the
+// refresh fails, the error is logged and another attempt is scheduled after
+// gcrRefreshRetryInterval so a transient failure can't strand the cache
+// with a token that silently expires. Any timer already pending is replaced
+// rather than left to run, so a burst of refreshes around the expiry
+// boundary can't accumulate multiple self-perpetuating chains (the cache is
+// a single shared value, not keyed per host).
+func (p *gcrCredentialProvider) scheduleRefresh(host string, after time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.refreshTimer != nil {
+		p.refreshTimer.Stop()
+	}
+	p.refreshTimer = time.AfterFunc(after, func() {
+		if _, err := p.refresh(host); err != nil {
+			p.logger.Printf("[ERR] driver.docker: failed refreshing GCR credentials for %q: %v; retrying in %s", host, err, gcrRefreshRetryInterval)
+			p.scheduleRefresh(host, gcrRefreshRetryInterval)
+		}
+	})
+}